@@ -0,0 +1,350 @@
+package tqs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator authorizes outgoing requests and, if given a challenge
+// response, attempts to satisfy it so the request can be retried.
+type Authenticator interface {
+	// Authorize sets whatever headers are needed to authenticate req.
+	Authorize(req *http.Request) error
+
+	// HandleChallenge is called with a 401 response. It should obtain
+	// whatever credentials the challenge demands, or return an error if
+	// it cannot. On success, the request is retried once with Authorize
+	// called again.
+	HandleChallenge(resp *http.Response) error
+}
+
+// StaticTokenAuthenticator sends a fixed token with every request, using
+// the same `Authentication: token <t>` scheme go-tqs has always used. It
+// cannot satisfy a WWW-Authenticate challenge.
+type StaticTokenAuthenticator struct {
+	Token string
+}
+
+func (a *StaticTokenAuthenticator) Authorize(req *http.Request) error {
+	if a.Token != "" {
+		req.Header.Set("Authentication", "token "+a.Token)
+	}
+	return nil
+}
+
+func (a *StaticTokenAuthenticator) HandleChallenge(resp *http.Response) error {
+	return fmt.Errorf("tqs: static token authenticator cannot satisfy auth challenge %q", resp.Header.Get("WWW-Authenticate"))
+}
+
+type cachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+func (t cachedToken) valid() bool {
+	return t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry))
+}
+
+// ChallengeAuthenticator satisfies WWW-Authenticate bearer-token
+// challenges, the flow used by registries such as the Docker
+// distribution API: a 401 response names a token endpoint (realm) plus
+// service/scope parameters, the client fetches a bearer token from that
+// endpoint, and retries the original request with it.
+type ChallengeAuthenticator struct {
+	// Client is used to call the token endpoint. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	mu     sync.Mutex
+	scope  string
+	tokens map[string]cachedToken
+}
+
+func (a *ChallengeAuthenticator) Authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.scope == "" {
+		return nil
+	}
+	if tok, ok := a.tokens[a.scope]; ok && tok.valid() {
+		req.Header.Set("Authorization", "Bearer "+tok.token)
+	}
+	return nil
+}
+
+func (a *ChallengeAuthenticator) HandleChallenge(resp *http.Response) error {
+	header := resp.Header.Get("WWW-Authenticate")
+	if header == "" {
+		return fmt.Errorf("tqs: 401 response missing WWW-Authenticate header")
+	}
+
+	scheme, params, err := parseWWWAuthenticate(header)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("tqs: unsupported WWW-Authenticate scheme %q", scheme)
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("tqs: WWW-Authenticate challenge is missing a realm")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return err
+	}
+	query := tokenURL.Query()
+	for key, value := range params {
+		if key == "realm" {
+			continue
+		}
+		query.Set(key, value)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("tqs: token endpoint returned HTTP status <%d>", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return err
+	}
+
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("tqs: token endpoint response did not contain a token")
+	}
+
+	var expiry time.Time
+	if tokenResponse.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+
+	scope := params["scope"]
+
+	a.mu.Lock()
+	if a.tokens == nil {
+		a.tokens = make(map[string]cachedToken)
+	}
+	a.tokens[scope] = cachedToken{token: token, expiry: expiry}
+	a.scope = scope
+	a.mu.Unlock()
+
+	return nil
+}
+
+// parseWWWAuthenticate splits a WWW-Authenticate header value into its
+// auth-scheme and parameter map, per RFC 2616: comma-separated
+// key=value pairs where value is either a token or a quoted-string with
+// backslash-escapes.
+func parseWWWAuthenticate(header string) (scheme string, params map[string]string, err error) {
+	header = strings.TrimSpace(header)
+
+	sp := strings.IndexAny(header, " \t")
+	if sp < 0 {
+		return header, map[string]string{}, nil
+	}
+	scheme = header[:sp]
+
+	rest := header[sp+1:]
+	params = make(map[string]string)
+
+	i, n := 0, len(rest)
+	for i < n {
+		for i < n && (rest[i] == ' ' || rest[i] == '\t' || rest[i] == ',') {
+			i++
+		}
+		if i >= n {
+			break
+		}
+
+		keyStart := i
+		for i < n && rest[i] != '=' {
+			i++
+		}
+		if i >= n {
+			return "", nil, fmt.Errorf("tqs: malformed WWW-Authenticate header %q", header)
+		}
+		key := strings.TrimSpace(rest[keyStart:i])
+		i++ // skip '='
+
+		var value strings.Builder
+		if i < n && rest[i] == '"' {
+			i++
+			for i < n && rest[i] != '"' {
+				if rest[i] == '\\' && i+1 < n {
+					i++
+				}
+				value.WriteByte(rest[i])
+				i++
+			}
+			if i >= n {
+				return "", nil, fmt.Errorf("tqs: unterminated quoted-string in WWW-Authenticate header %q", header)
+			}
+			i++ // skip closing quote
+		} else {
+			for i < n && rest[i] != ',' {
+				value.WriteByte(rest[i])
+				i++
+			}
+		}
+
+		params[key] = strings.TrimSpace(value.String())
+	}
+
+	return scheme, params, nil
+}
+
+// authenticator returns the Queue's configured Authenticator, falling
+// back to a StaticTokenAuthenticator built from the legacy token field
+// so existing callers of NewQueue keep working unchanged.
+func (q Queue) authenticator() Authenticator {
+	if q.auth != nil {
+		return q.auth
+	}
+	return &StaticTokenAuthenticator{Token: q.token}
+}
+
+// QueueAuthError reports that a 401 response's challenge could not be
+// satisfied, for example because the Authenticator doesn't support
+// challenges, the token endpoint was unreachable, or the challenge
+// itself was malformed. Callers must not treat the (absent) response as
+// a normal, successful one.
+type QueueAuthError struct {
+	queue      Queue
+	StatusCode int
+	Err        error
+}
+
+func (e *QueueAuthError) Error() string {
+	return fmt.Sprintf("Queue <%s> could not satisfy auth challenge (HTTP %d): %v", e.queue.Name, e.StatusCode, e.Err)
+}
+
+func (e *QueueAuthError) Unwrap() error {
+	return e.Err
+}
+
+// doRequest builds and sends an HTTP request through the queue's
+// Authenticator, retrying once if the first attempt comes back 401 and
+// the Authenticator can satisfy the challenge. It is the single code
+// path used by every Queue and Message method that talks to the server.
+func (q Queue) doRequest(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	auth := q.authenticator()
+
+	res, err := q.sendRequest(ctx, auth, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		challengeErr := auth.HandleChallenge(res)
+		res.Body.Close()
+		if challengeErr != nil {
+			return nil, &QueueAuthError{queue: q, StatusCode: res.StatusCode, Err: challengeErr}
+		}
+		return q.sendRequest(ctx, auth, method, url, body)
+	}
+
+	return res, nil
+}
+
+// requestError wraps a transport-level error (one that meant no response
+// was ever received) with whether the request had been fully written to
+// the wire before it occurred. That distinguishes "definitely never
+// reached the server" from "may have reached the server, the response
+// was just lost", which matters for deciding whether a non-idempotent
+// request is safe to retry.
+type requestError struct {
+	err          error
+	wroteRequest bool
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func (q Queue) sendRequest(ctx context.Context, auth Authenticator, method, url string, body []byte) (*http.Response, error) {
+	client := http.Client{}
+
+	var bodyReader *bytes.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	wroteRequest := false
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			wroteRequest = info.Err == nil
+		},
+	})
+
+	var req *http.Request
+	var err error
+	if bodyReader != nil {
+		req, err = http.NewRequestWithContext(ctx, method, url, bodyReader)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := auth.Authorize(req); err != nil {
+		return nil, err
+	}
+	req.Close = true
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, &requestError{err: err, wroteRequest: wroteRequest}
+	}
+	return res, nil
+}
@@ -0,0 +1,151 @@
+package tqs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStatisticsReturnsAuthErrorOnUnsatisfiableChallenge guards against a
+// 401 whose challenge can't be satisfied being swallowed and reported as
+// a zero-value, successful result (see doRequest's challenge handling).
+func TestStatisticsReturnsAuthErrorOnUnsatisfiableChallenge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://example.test/token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	q := NewQueue(server.URL, "test-queue", "some-token")
+
+	stats, err := q.Statistics()
+	if err == nil {
+		t.Fatalf("Statistics() returned nil error with stats %+v; want a QueueAuthError", stats)
+	}
+
+	var authErr *QueueAuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("Statistics() error = %v (%T); want *QueueAuthError", err, err)
+	}
+	if authErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("authErr.StatusCode = %d, want %d", authErr.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	cases := []struct {
+		name       string
+		header     string
+		wantScheme string
+		wantParams map[string]string
+	}{
+		{
+			name:       "single unquoted param",
+			header:     `Bearer realm=example`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{"realm": "example"},
+		},
+		{
+			name:       "quoted values with multiple params",
+			header:     `Bearer realm="https://example.test/token",service="registry.example.test",scope="repository:foo:pull"`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{
+				"realm":   "https://example.test/token",
+				"service": "registry.example.test",
+				"scope":   "repository:foo:pull",
+			},
+		},
+		{
+			name:       "backslash-escaped quote inside a quoted-string",
+			header:     `Bearer realm="https://example.test/\"token\""`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{"realm": `https://example.test/"token"`},
+		},
+		{
+			name:       "scheme only, no params",
+			header:     `Negotiate`,
+			wantScheme: "Negotiate",
+			wantParams: map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scheme, params, err := parseWWWAuthenticate(c.header)
+			if err != nil {
+				t.Fatalf("parseWWWAuthenticate(%q): %v", c.header, err)
+			}
+			if scheme != c.wantScheme {
+				t.Errorf("scheme = %q, want %q", scheme, c.wantScheme)
+			}
+			if !reflect.DeepEqual(params, c.wantParams) {
+				t.Errorf("params = %#v, want %#v", params, c.wantParams)
+			}
+		})
+	}
+}
+
+func TestParseWWWAuthenticateMalformed(t *testing.T) {
+	cases := []string{
+		`Bearer realm`,
+		`Bearer realm="unterminated`,
+	}
+	for _, header := range cases {
+		if _, _, err := parseWWWAuthenticate(header); err == nil {
+			t.Errorf("parseWWWAuthenticate(%q): want error, got nil", header)
+		}
+	}
+}
+
+// TestChallengeAuthenticatorSatisfiesTokenChallenge exercises the
+// happy path end-to-end: a 401 names a token endpoint, the
+// ChallengeAuthenticator fetches and caches a bearer token from it, and
+// the original request is retried and succeeds.
+func TestChallengeAuthenticatorSatisfiesTokenChallenge(t *testing.T) {
+	const wantToken = "s3cr3t-token"
+
+	var tokenRequests int64
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&tokenRequests, 1)
+		if got := r.URL.Query().Get("scope"); got != "repository:foo:pull" {
+			t.Errorf("token request scope = %q, want %q", got, "repository:foo:pull")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":%q,"expires_in":3600}`, wantToken)
+	}))
+	defer tokenServer.Close()
+
+	var challenged int32
+	resourceServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&challenged, 0, 1) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s",service="registry.example.test",scope="repository:foo:pull"`,
+				tokenServer.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer "+wantToken {
+			t.Errorf("resource request Authorization = %q, want %q", got, "Bearer "+wantToken)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"visible":1,"delayed":0,"leased":0}`))
+	}))
+	defer resourceServer.Close()
+
+	q := NewQueueWithAuthenticator(resourceServer.URL, "test-queue", &ChallengeAuthenticator{})
+
+	stats, err := q.Statistics()
+	if err != nil {
+		t.Fatalf("Statistics(): %v", err)
+	}
+	if stats.Visible != 1 {
+		t.Errorf("stats.Visible = %d, want 1", stats.Visible)
+	}
+	if got := atomic.LoadInt64(&tokenRequests); got != 1 {
+		t.Errorf("token endpoint saw %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,198 @@
+package tqs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HandlerFunc processes a single message. The context passed to it is
+// cancelled when the message's lease is about to expire and renewal has
+// failed, or when the owning Consumer is shut down.
+type HandlerFunc func(ctx context.Context, m Message) error
+
+// ConsumerOptions configures a Consumer's worker pool and polling
+// behavior.
+type ConsumerOptions struct {
+	// Concurrency is the number of worker goroutines polling the queue.
+	// Defaults to 1.
+	Concurrency int
+
+	// Wait is the long-poll wait time passed to Queue.Get. Defaults to
+	// 10 seconds.
+	Wait time.Duration
+
+	// MaxInFlight caps the number of messages being handled at once.
+	// Defaults to Concurrency.
+	MaxInFlight int
+
+	// RenewInterval is the fallback interval used to renew a message's
+	// lease when the message does not report a LeaseTimeout. Defaults
+	// to 30 seconds.
+	RenewInterval time.Duration
+
+	// ErrorBackoff paces re-polling after Queue.Get fails with anything
+	// other than QueueEmptyError (queue-not-found, auth failures, 5xx,
+	// network errors, ...), so a persistently failing broker doesn't
+	// turn a worker into a tight retry loop. Only BaseDelay, MaxDelay
+	// and Jitter are used. Defaults to DefaultRetryPolicy's backoff.
+	ErrorBackoff RetryPolicy
+}
+
+func (o ConsumerOptions) withDefaults() ConsumerOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.Wait <= 0 {
+		o.Wait = time.Second * 10
+	}
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = o.Concurrency
+	}
+	if o.RenewInterval <= 0 {
+		o.RenewInterval = time.Second * 30
+	}
+	if o.ErrorBackoff.BaseDelay <= 0 && o.ErrorBackoff.MaxDelay <= 0 {
+		o.ErrorBackoff = DefaultRetryPolicy()
+	}
+	o.ErrorBackoff = o.ErrorBackoff.withDefaults()
+	return o
+}
+
+// Consumer runs a pool of workers that long-poll a Queue and dispatch
+// messages to a HandlerFunc, automatically renewing leases for
+// long-running handlers and releasing or deleting messages depending on
+// the handler's outcome.
+type Consumer struct {
+	queue   Queue
+	handler HandlerFunc
+	options ConsumerOptions
+
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewConsumer creates a Consumer that reads from q and dispatches
+// messages to handler. Call Start to begin polling and Shutdown to stop.
+func NewConsumer(q Queue, handler HandlerFunc, options ConsumerOptions) *Consumer {
+	options = options.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Consumer{
+		queue:   q,
+		handler: handler,
+		options: options,
+		sem:     make(chan struct{}, options.MaxInFlight),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Start launches the consumer's worker goroutines. It returns
+// immediately; workers run until Shutdown is called.
+func (c *Consumer) Start() {
+	for i := 0; i < c.options.Concurrency; i++ {
+		c.wg.Add(1)
+		go c.run()
+	}
+}
+
+// Shutdown stops the consumer from accepting new messages, waits for
+// in-flight handlers to finish, and releases any leases that were not
+// acknowledged. It returns ctx's error if ctx is done before the workers
+// finish draining.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Consumer) run() {
+	defer c.wg.Done()
+
+	errorStreak := 0
+
+	for {
+		select {
+		case c.sem <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+
+		msg, err := c.queue.GetContext(c.ctx, &GetOptions{Wait: c.options.Wait})
+		if err != nil {
+			<-c.sem
+			if _, ok := err.(*QueueEmptyError); ok {
+				errorStreak = 0
+				continue
+			}
+			if c.ctx.Err() != nil {
+				return
+			}
+			errorStreak++
+			if !sleepForRetry(c.ctx, c.options.ErrorBackoff.backoff(errorStreak)) {
+				return
+			}
+			continue
+		}
+		errorStreak = 0
+
+		c.wg.Add(1)
+		go c.handle(msg)
+	}
+}
+
+func (c *Consumer) handle(msg Message) {
+	defer c.wg.Done()
+	defer func() { <-c.sem }()
+
+	leaseTimeout := time.Duration(msg.LeaseTimeout) * time.Second
+	if leaseTimeout <= 0 {
+		leaseTimeout = c.options.RenewInterval * 2
+	}
+	renewInterval := leaseTimeout / 2
+
+	msgCtx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		ticker := time.NewTicker(renewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-msgCtx.Done():
+				return
+			case <-ticker.C:
+				if err := msg.RenewLeaseContext(c.ctx, leaseTimeout); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := c.handler(msgCtx, msg)
+	cancel()
+	<-heartbeatDone
+
+	releaseCtx := context.Background()
+	if err != nil {
+		msg.ReleaseContext(releaseCtx)
+		return
+	}
+	msg.DeleteContext(releaseCtx)
+}
@@ -0,0 +1,161 @@
+package tqs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConsumerBacksOffOnPersistentErrors guards against Consumer.run
+// re-polling a failing queue with no backoff, which would turn a
+// misbehaving broker into a client-side DoS against itself.
+func TestConsumerBacksOffOnPersistentErrors(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	q := NewQueue(server.URL, "test-queue", "")
+	consumer := NewConsumer(q, func(ctx context.Context, m Message) error {
+		return nil
+	}, ConsumerOptions{
+		ErrorBackoff: RetryPolicy{BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond},
+	})
+
+	consumer.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := consumer.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if got := atomic.LoadInt64(&requests); got > 30 {
+		t.Errorf("got %d requests against an always-failing server in 200ms, want a bounded number given ~20ms backoff", got)
+	}
+}
+
+// TestConsumerShutdownDrainsInFlightHandler checks that Shutdown waits
+// for an in-flight handler to finish and that its outcome (success, here)
+// deletes the message's lease.
+func TestConsumerShutdownDrainsInFlightHandler(t *testing.T) {
+	var gotMessage int64
+	var deleted int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			atomic.AddInt64(&deleted, 1)
+			w.WriteHeader(http.StatusOK)
+		case atomic.CompareAndSwapInt64(&gotMessage, 0, 1):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(GetMessagesResponse{Messages: []Message{
+				{BodyText: "hi", BodyType: "text/plain", LeaseUUID: "lease-1", LeaseTimeout: 3600},
+			}})
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(GetMessagesResponse{})
+		}
+	}))
+	defer server.Close()
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+
+	q := NewQueue(server.URL, "test-queue", "")
+	consumer := NewConsumer(q, func(ctx context.Context, m Message) error {
+		close(handling)
+		<-release
+		return nil
+	}, ConsumerOptions{})
+
+	consumer.Start()
+
+	select {
+	case <-handling:
+	case <-time.After(time.Second):
+		t.Fatal("handler was never invoked")
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- consumer.Shutdown(context.Background())
+	}()
+
+	close(release)
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after handler finished")
+	}
+
+	if atomic.LoadInt64(&deleted) != 1 {
+		t.Errorf("deleted = %d, want 1", atomic.LoadInt64(&deleted))
+	}
+}
+
+// TestConsumerDoesNotLeaseAheadOfHandlerSlots guards against run()
+// fetching (and leasing) a message from the server before a handler slot
+// is actually free to service it: a message leased that far ahead has no
+// renewal heartbeat yet and can silently expire while parked, producing
+// a duplicate delivery.
+func TestConsumerDoesNotLeaseAheadOfHandlerSlots(t *testing.T) {
+	var getRequests int64
+	release := make(chan struct{})
+	handlerStarted := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		n := atomic.AddInt64(&getRequests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetMessagesResponse{Messages: []Message{
+			{BodyText: "hi", BodyType: "text/plain", LeaseUUID: fmt.Sprintf("lease-%d", n), LeaseTimeout: 3600},
+		}})
+	}))
+	defer server.Close()
+
+	q := NewQueue(server.URL, "test-queue", "")
+	consumer := NewConsumer(q, func(ctx context.Context, m Message) error {
+		select {
+		case handlerStarted <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}, ConsumerOptions{})
+
+	consumer.Start()
+
+	select {
+	case <-handlerStarted:
+	case <-time.After(time.Second):
+		t.Fatal("handler never started")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt64(&getRequests); got != 1 {
+		t.Errorf("server saw %d GET requests while the only handler slot was occupied, want 1", got)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := consumer.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
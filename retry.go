@@ -0,0 +1,254 @@
+package tqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how a Queue retries failed requests.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// A Queue with no RetryPolicy behaves as if MaxAttempts is 1, i.e.
+	// it never retries.
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the second attempt; each
+	// subsequent attempt doubles it, capped at MaxDelay.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff computed from BaseDelay.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of the computed delay (0-1) to randomly
+	// add or subtract, to avoid synchronized retries across clients.
+	Jitter float64
+
+	// AttemptTimeout, if set, bounds each individual attempt. It is
+	// independent of any deadline already on the context passed to the
+	// call.
+	AttemptTimeout time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 1
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 100 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 10 * time.Second
+	}
+	return p
+}
+
+// DefaultRetryPolicy retries up to 3 attempts total, backing off from
+// 100ms up to 5s with 20% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if max := float64(p.MaxDelay); delay > max {
+		delay = max
+	}
+	if p.Jitter > 0 {
+		spread := delay * p.Jitter
+		delay += (rand.Float64()*2 - 1) * spread
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// QueueTransientError wraps the last error seen after a request
+// exhausted its RetryPolicy, so callers can recognize a persistently
+// unreachable or unhealthy broker with errors.As, separately from
+// errors like QueueNotFoundError that mean the request succeeded but
+// was rejected.
+type QueueTransientError struct {
+	queue Queue
+	Err   error
+}
+
+func (e *QueueTransientError) Error() string {
+	return fmt.Sprintf("Queue <%s> still failing after retries: %v", e.queue.Name, e.Err)
+}
+
+func (e *QueueTransientError) Unwrap() error {
+	return e.Err
+}
+
+// WithRetryPolicy returns a copy of the queue that retries requests
+// according to policy. A Queue returned by NewQueue has no RetryPolicy
+// and never retries, matching go-tqs's historical behavior.
+func (q Queue) WithRetryPolicy(policy RetryPolicy) Queue {
+	policy = policy.withDefaults()
+	q.retry = &policy
+	return q
+}
+
+func (q Queue) retryPolicy() RetryPolicy {
+	if q.retry != nil {
+		return *q.retry
+	}
+	return RetryPolicy{MaxAttempts: 1}.withDefaults()
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || (statusCode >= 500 && statusCode <= 599)
+}
+
+// retryAfterDelay parses a Retry-After header, which per RFC 7231 is
+// either a number of seconds or an HTTP-date.
+func retryAfterDelay(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when), true
+	}
+	return 0, false
+}
+
+// cancelOnClose ties a context cancel func to a response body's Close,
+// so a per-attempt timeout can be released once the caller is done
+// reading the response instead of the moment the attempt succeeds.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// doRequestRetrying sends a request through doRequest, retrying
+// according to the queue's RetryPolicy on network errors and on 5xx/429
+// responses, honoring Retry-After when present. idempotent must be false
+// for operations like Put and Create that must not be replayed once the
+// server may have applied them; for those, a network error is only
+// retried when the underlying transport never finished writing the
+// request (per httptrace.ClientTrace.WroteRequest), since that is the
+// one case where the request cannot have reached the server. Once a
+// request may have reached the server, retrying it would risk applying
+// it twice.
+func (q Queue) doRequestRetrying(ctx context.Context, method, url string, body []byte, idempotent bool) (*http.Response, error) {
+	policy := q.retryPolicy()
+
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		attemptCtx := ctx
+		var cancel context.CancelFunc
+		if policy.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, policy.AttemptTimeout)
+		}
+
+		res, err := q.doRequest(attemptCtx, method, url, body)
+		if err != nil {
+			if cancel != nil {
+				cancel()
+			}
+			lastErr = err
+			if attempt == policy.MaxAttempts || !retryableError(err, idempotent) {
+				return nil, q.finalError(policy, lastErr)
+			}
+			if !sleepForRetry(ctx, policy.backoff(attempt)) {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		if !idempotent || !isRetryableStatus(res.StatusCode) {
+			if cancel != nil {
+				res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			}
+			return res, nil
+		}
+
+		delay := policy.backoff(attempt)
+		if after, ok := retryAfterDelay(res.Header.Get("Retry-After")); ok {
+			delay = after
+		}
+
+		lastErr = &QueueHTTPError{queue: q, StatusCode: res.StatusCode}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if cancel != nil {
+			cancel()
+		}
+
+		if attempt == policy.MaxAttempts {
+			break
+		}
+		if !sleepForRetry(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, q.finalError(policy, lastErr)
+}
+
+// retryableError reports whether err is worth a retry attempt. Only a
+// requestError (a transport-level failure, not a response doRequest
+// rejected for some other reason such as QueueAuthError) is ever
+// retryable, since retries are scoped to network errors and transient
+// 5xx/429 responses; a deterministic failure like an unsatisfiable auth
+// challenge would just be retried into the same outcome. For
+// non-idempotent requests, a requestError is retryable only when the
+// request was never fully written, since anything else means the server
+// may already have processed it.
+func retryableError(err error, idempotent bool) bool {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	if idempotent {
+		return true
+	}
+	return !reqErr.wroteRequest
+}
+
+// finalError wraps err in a QueueTransientError only when a RetryPolicy
+// was actually attached to the queue (MaxAttempts > 1); otherwise it
+// returns err unchanged so callers of a plain NewQueue, which never
+// retries, keep seeing the same errors they always have.
+func (q Queue) finalError(policy RetryPolicy, err error) error {
+	if policy.MaxAttempts <= 1 {
+		return err
+	}
+	return &QueueTransientError{queue: q, Err: err}
+}
+
+// sleepForRetry waits for delay or ctx's cancellation, whichever comes
+// first. It reports whether the wait completed normally.
+func sleepForRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
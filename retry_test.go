@@ -0,0 +1,137 @@
+package tqs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDoRequestRetryingRetriesTransientStatus checks that an idempotent
+// request is retried past 5xx responses when a RetryPolicy is attached,
+// and eventually succeeds.
+func TestDoRequestRetryingRetriesTransientStatus(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"visible":0,"delayed":0,"leased":0}`))
+	}))
+	defer server.Close()
+
+	q := NewQueue(server.URL, "test-queue", "").WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   5 * time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	})
+
+	if _, err := q.Statistics(); err != nil {
+		t.Fatalf("Statistics(): %v", err)
+	}
+	if got := atomic.LoadInt64(&requests); got != 3 {
+		t.Errorf("server saw %d requests, want 3", got)
+	}
+}
+
+// TestDoRequestRetryingNoPolicyReturnsBareError checks that a Queue with
+// no RetryPolicy attached (the NewQueue default) never wraps its errors
+// in QueueTransientError, so existing callers that type-assert or
+// string-match on errors keep seeing what they always have.
+func TestDoRequestRetryingNoPolicyReturnsBareError(t *testing.T) {
+	q := NewQueue("http://127.0.0.1:1", "test-queue", "")
+
+	_, err := q.Statistics()
+	if err == nil {
+		t.Fatal("Statistics() against an unreachable endpoint returned nil error")
+	}
+
+	var transientErr *QueueTransientError
+	if errors.As(err, &transientErr) {
+		t.Errorf("Statistics() error = %v; want a bare error, not QueueTransientError, since no RetryPolicy is attached", err)
+	}
+}
+
+// TestDoRequestRetryingWrapsWhenPolicyAttached is the converse of
+// TestDoRequestRetryingNoPolicyReturnsBareError: once a RetryPolicy is
+// attached, exhausting it should surface a QueueTransientError.
+func TestDoRequestRetryingWrapsWhenPolicyAttached(t *testing.T) {
+	q := NewQueue("http://127.0.0.1:1", "test-queue", "").WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   1 * time.Millisecond,
+		MaxDelay:    1 * time.Millisecond,
+	})
+
+	_, err := q.Statistics()
+	if err == nil {
+		t.Fatal("Statistics() against an unreachable endpoint returned nil error")
+	}
+
+	var transientErr *QueueTransientError
+	if !errors.As(err, &transientErr) {
+		t.Errorf("Statistics() error = %v (%T); want *QueueTransientError", err, err)
+	}
+}
+
+// TestRetryableErrorGatesNonIdempotentRequests checks the idempotency
+// boundary directly: a non-idempotent request (Put/Create) is only
+// retryable when the transport never finished writing it to the wire,
+// since once it may have reached the server, retrying risks replaying it.
+func TestRetryableErrorGatesNonIdempotentRequests(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{"idempotent, never wrote request retries", &requestError{err: errors.New("boom"), wroteRequest: false}, true, true},
+		{"idempotent, request already wrote still retries", &requestError{err: errors.New("boom"), wroteRequest: true}, true, true},
+		{"non-idempotent, never wrote request", &requestError{err: errors.New("boom"), wroteRequest: false}, false, true},
+		{"non-idempotent, request already wrote", &requestError{err: errors.New("boom"), wroteRequest: true}, false, false},
+		{"non-idempotent, non-requestError", errors.New("boom"), false, false},
+		{"idempotent, non-requestError (e.g. QueueAuthError) never retries", &QueueAuthError{Err: errors.New("boom")}, true, false},
+	}
+
+	for _, c := range cases {
+		if got := retryableError(c.err, c.idempotent); got != c.want {
+			t.Errorf("%s: retryableError() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestDoRequestRetryingDoesNotRetryAuthError checks that an idempotent
+// request with a RetryPolicy attached doesn't burn attempts and backoff
+// on an unsatisfiable auth challenge, which will never succeed no matter
+// how many times it's retried.
+func TestDoRequestRetryingDoesNotRetryAuthError(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://example.test/token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	q := NewQueue(server.URL, "test-queue", "some-token").WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   20 * time.Millisecond,
+		MaxDelay:    20 * time.Millisecond,
+	})
+
+	_, err := q.Statistics()
+	if err == nil {
+		t.Fatal("Statistics() returned nil error for an unsatisfiable auth challenge")
+	}
+
+	var authErr *QueueAuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("Statistics() error = %v (%T); want *QueueAuthError", err, err)
+	}
+	if got := atomic.LoadInt64(&requests); got != 1 {
+		t.Errorf("server saw %d requests, want 1 (auth errors should not be retried)", got)
+	}
+}
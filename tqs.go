@@ -1,20 +1,31 @@
 package tqs
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
 
+// defaultTimeout is the deadline applied by the methods below that
+// historically had a fixed 2 second timeout (Delete, Statistics, Exists,
+// Create); Get and Put never had one and still don't. Every method here
+// has a ...Context counterpart taking a context.Context directly instead
+// of this default, for callers that want their own deadline or want to
+// cancel in flight.
+const defaultTimeout = time.Second * 2
+
 type Queue struct {
 	Endpoint string
 	Name     string
 	url      string
 	token    string
+	auth     Authenticator
+	retry    *RetryPolicy
 }
 
 type Message struct {
@@ -37,22 +48,69 @@ func (e *LeaseNotFoundError) Error() string {
 	return fmt.Sprintf("Lease <%s> does not exist or expired", e.message.LeaseUUID)
 }
 
+// Delete removes the message's lease, permanently removing it from the
+// queue.
 func (m Message) Delete() error {
-	client := http.Client{Timeout: time.Second * 2}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return m.DeleteContext(ctx)
+}
 
+// DeleteContext is like Delete but takes a context.Context governing the
+// request, allowing callers to enforce their own deadlines or cancel the
+// call in flight.
+func (m Message) DeleteContext(ctx context.Context) error {
 	url := fmt.Sprintf("%s/leases/%s", m.queue.url, m.LeaseUUID)
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	res, err := m.queue.doRequestRetrying(ctx, http.MethodDelete, url, nil, true)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	if m.queue.token != "" {
-		req.Header.Set("Authentication", "token "+m.queue.token)
+	if res.StatusCode == 404 {
+		return &LeaseNotFoundError{message: m}
 	}
 
-	req.Close = true
+	return nil
+}
 
-	res, err := client.Do(req)
+type renewLeaseRequest struct {
+	Timeout int `json:"timeout"`
+}
+
+// RenewLease extends the message's lease by the given duration, keeping
+// it invisible to other consumers.
+func (m Message) RenewLease(extend time.Duration) error {
+	return m.RenewLeaseContext(context.Background(), extend)
+}
+
+// RenewLeaseContext is like RenewLease but takes a context.Context
+// governing the request.
+func (m Message) RenewLeaseContext(ctx context.Context, extend time.Duration) error {
+	return m.setLeaseTimeout(ctx, extend)
+}
+
+// Release returns the message to the queue immediately by zeroing its
+// lease, making it visible to other consumers again.
+func (m Message) Release() error {
+	return m.ReleaseContext(context.Background())
+}
+
+// ReleaseContext is like Release but takes a context.Context governing
+// the request.
+func (m Message) ReleaseContext(ctx context.Context) error {
+	return m.setLeaseTimeout(ctx, 0)
+}
+
+func (m Message) setLeaseTimeout(ctx context.Context, timeout time.Duration) error {
+	request := renewLeaseRequest{Timeout: int(timeout / time.Second)}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/leases/%s", m.queue.url, m.LeaseUUID)
+	res, err := m.queue.doRequestRetrying(ctx, http.MethodPut, url, data, true)
 	if err != nil {
 		return err
 	}
@@ -62,6 +120,10 @@ func (m Message) Delete() error {
 		return &LeaseNotFoundError{message: m}
 	}
 
+	if res.StatusCode != 200 {
+		return &QueueHTTPError{queue: m.queue, StatusCode: res.StatusCode}
+	}
+
 	return nil
 }
 
@@ -113,20 +175,31 @@ func NewQueue(endpoint string, name string, token string) Queue {
 	}
 }
 
-func (q Queue) Statistics() (QueueStatistics, error) {
-	client := http.Client{Timeout: time.Second * 2}
-
-	url := fmt.Sprintf("%s/statistics", q.url)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return QueueStatistics{}, err
+// NewQueueWithAuthenticator is like NewQueue but lets the caller plug in
+// an Authenticator instead of a single static token, for example a
+// ChallengeAuthenticator for registries that require a WWW-Authenticate
+// token exchange.
+func NewQueueWithAuthenticator(endpoint string, name string, auth Authenticator) Queue {
+	return Queue{
+		Endpoint: endpoint,
+		Name:     name,
+		url:      fmt.Sprintf("%s/queues/%s", endpoint, name),
+		auth:     auth,
 	}
+}
 
-	if q.token != "" {
-		req.Header.Set("Authentication", "token "+q.token)
-	}
+// Statistics fetches the queue's current statistics.
+func (q Queue) Statistics() (QueueStatistics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return q.StatisticsContext(ctx)
+}
 
-	res, err := client.Do(req)
+// StatisticsContext is like Statistics but takes a context.Context
+// governing the request.
+func (q Queue) StatisticsContext(ctx context.Context) (QueueStatistics, error) {
+	url := fmt.Sprintf("%s/statistics", q.url)
+	res, err := q.doRequestRetrying(ctx, http.MethodGet, url, nil, true)
 	if err != nil {
 		return QueueStatistics{}, err
 	}
@@ -139,7 +212,7 @@ func (q Queue) Statistics() (QueueStatistics, error) {
 
 	body, readErr := ioutil.ReadAll(res.Body)
 	if readErr != nil {
-		return QueueStatistics{}, err
+		return QueueStatistics{}, readErr
 	}
 
 	statistics := QueueStatistics{}
@@ -150,8 +223,17 @@ func (q Queue) Statistics() (QueueStatistics, error) {
 	return statistics, nil
 }
 
+// Exists reports whether the queue has been created on the server.
 func (q Queue) Exists() (bool, error) {
-	_, err := q.Statistics()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return q.ExistsContext(ctx)
+}
+
+// ExistsContext is like Exists but takes a context.Context governing the
+// request.
+func (q Queue) ExistsContext(ctx context.Context) (bool, error) {
+	_, err := q.StatisticsContext(ctx)
 	if err != nil {
 		if _, ok := err.(*QueueNotFoundError); ok {
 			return false, nil
@@ -165,9 +247,16 @@ type CreateQueueRequest struct {
 	Name string `json:"name"`
 }
 
+// Create registers the queue on the server.
 func (q Queue) Create() error {
-	client := http.Client{Timeout: time.Second * 2}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return q.CreateContext(ctx)
+}
 
+// CreateContext is like Create but takes a context.Context governing the
+// request.
+func (q Queue) CreateContext(ctx context.Context) error {
 	createRequest := CreateQueueRequest{Name: q.Name}
 	data, err := json.Marshal(createRequest)
 	if err != nil {
@@ -175,19 +264,7 @@ func (q Queue) Create() error {
 	}
 
 	url := fmt.Sprintf("%s/queues", q.Endpoint)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-
-	if q.token != "" {
-		req.Header.Set("Authentication", "token "+q.token)
-	}
-
-	req.Close = true
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := client.Do(req)
+	res, err := q.doRequestRetrying(ctx, http.MethodPost, url, data, false)
 	if err != nil {
 		return err
 	}
@@ -215,40 +292,62 @@ type GetOptions struct {
 	Retry  bool
 }
 
+// getURL builds the Queue's request URL with the query parameters Get
+// and GetBatch understand: delete, wait_time, and, for batches, max.
+func (q Queue) getURL(options *GetOptions, max int) (string, error) {
+	reqURL, err := url.Parse(q.url)
+	if err != nil {
+		return "", err
+	}
+
+	query := reqURL.Query()
+	if max > 0 {
+		query.Set("max", strconv.Itoa(max))
+	}
+	if options != nil {
+		if options.Delete {
+			query.Set("delete", "true")
+		}
+		if options.Wait > 0 {
+			query.Set("wait_time", strconv.Itoa(int(options.Wait)/1000000000))
+		}
+	}
+	reqURL.RawQuery = query.Encode()
+
+	return reqURL.String(), nil
+}
+
+// GetValue fetches a single message and unmarshals its body as JSON into
+// v.
 func (q Queue) GetValue(options *GetOptions, v interface{}) error {
-	msg, err := q.Get(options)
+	return q.GetValueContext(context.Background(), options, v)
+}
+
+// GetValueContext is like GetValue but takes a context.Context governing
+// the request.
+func (q Queue) GetValueContext(ctx context.Context, options *GetOptions, v interface{}) error {
+	msg, err := q.GetContext(ctx, options)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal([]byte(msg.BodyText), v)
 }
 
+// Get fetches a single message from the queue. Use GetContext to bound a
+// long-poll (GetOptions.Wait) with a deadline.
 func (q Queue) Get(options *GetOptions) (Message, error) {
-	client := http.Client{}
+	return q.GetContext(context.Background(), options)
+}
 
-	req, err := http.NewRequest(http.MethodGet, q.url, nil)
+// GetContext is like Get but takes a context.Context governing the
+// request.
+func (q Queue) GetContext(ctx context.Context, options *GetOptions) (Message, error) {
+	reqURL, err := q.getURL(options, 0)
 	if err != nil {
 		return Message{}, err
 	}
 
-	if q.token != "" {
-		req.Header.Set("Authentication", "token "+q.token)
-	}
-
-	req.Close = true
-
-	if options != nil {
-		q := req.URL.Query()
-		if options.Delete {
-			q.Set("delete", "true")
-		}
-		if options.Wait > 0 {
-			q.Set("wait_time", strconv.Itoa(int(options.Wait)/1000000000))
-		}
-		req.URL.RawQuery = q.Encode()
-	}
-
-	res, err := client.Do(req)
+	res, err := q.doRequestRetrying(ctx, http.MethodGet, reqURL, nil, true)
 	if err != nil {
 		return Message{}, err
 	}
@@ -261,7 +360,7 @@ func (q Queue) Get(options *GetOptions) (Message, error) {
 
 	body, readErr := ioutil.ReadAll(res.Body)
 	if readErr != nil {
-		return Message{}, err
+		return Message{}, readErr
 	}
 
 	response := GetMessagesResponse{}
@@ -278,40 +377,207 @@ func (q Queue) Get(options *GetOptions) (Message, error) {
 	return Message{}, &QueueEmptyError{queue: q}
 }
 
+// GetBatch fetches up to max messages from the queue in a single request.
+// Use GetBatchContext to bound a long-poll (GetOptions.Wait) with a
+// deadline.
+func (q Queue) GetBatch(options *GetOptions, max int) ([]Message, error) {
+	return q.GetBatchContext(context.Background(), options, max)
+}
+
+// GetBatchContext is like GetBatch but takes a context.Context governing
+// the request.
+func (q Queue) GetBatchContext(ctx context.Context, options *GetOptions, max int) ([]Message, error) {
+	reqURL, err := q.getURL(options, max)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := q.doRequestRetrying(ctx, http.MethodGet, reqURL, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &QueueNotFoundError{queue: q}
+	}
+
+	body, readErr := ioutil.ReadAll(res.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	response := GetMessagesResponse{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	if len(response.Messages) == 0 {
+		return nil, &QueueEmptyError{queue: q}
+	}
+
+	for i := range response.Messages {
+		response.Messages[i].queue = q
+	}
+
+	return response.Messages, nil
+}
+
 type MessageBody struct {
-	Text string `json:"body"`
-	Type string `json:"type"`
+	Text         string     `json:"body"`
+	Type         string     `json:"type"`
+	VisibleDate  *time.Time `json:"visible_date,omitempty"`
+	ExpireDate   *time.Time `json:"expire_date,omitempty"`
+	LeaseTimeout int        `json:"lease_timeout,omitempty"`
+}
+
+// PutOptions controls delayed delivery, expiry, and lease duration for a
+// message handed to PutWithOptions or PutBatchWithOptions. Delay and TTL
+// are translated to absolute VisibleAt/ExpireAt times at send time;
+// setting VisibleAt or ExpireAt directly takes precedence over the
+// corresponding duration.
+type PutOptions struct {
+	Delay        time.Duration
+	TTL          time.Duration
+	VisibleAt    time.Time
+	ExpireAt     time.Time
+	LeaseTimeout int
+}
+
+// NewMessageBody builds a MessageBody for bodyText/bodyType, applying
+// opts's delay, TTL, scheduling and lease settings. opts may be nil.
+func NewMessageBody(bodyText, bodyType string, opts *PutOptions) MessageBody {
+	body := MessageBody{Text: bodyText, Type: bodyType}
+	if opts == nil {
+		return body
+	}
+
+	visibleAt := opts.VisibleAt
+	if visibleAt.IsZero() && opts.Delay > 0 {
+		visibleAt = time.Now().Add(opts.Delay)
+	}
+	if !visibleAt.IsZero() {
+		body.VisibleDate = &visibleAt
+	}
+
+	expireAt := opts.ExpireAt
+	if expireAt.IsZero() && opts.TTL > 0 {
+		expireAt = time.Now().Add(opts.TTL)
+	}
+	if !expireAt.IsZero() {
+		body.ExpireDate = &expireAt
+	}
+
+	body.LeaseTimeout = opts.LeaseTimeout
+
+	return body
 }
 
 type PutMessageRequest struct {
 	Messages []MessageBody `json:"messages"`
 }
 
+// Put sends a single message to the queue.
 func (q Queue) Put(bodyText, bodyType string) error {
-	client := http.Client{}
+	return q.PutContext(context.Background(), bodyText, bodyType)
+}
 
-	request := PutMessageRequest{
-		Messages: []MessageBody{MessageBody{Text: bodyText, Type: bodyType}},
-	}
+// PutContext is like Put but takes a context.Context governing the
+// request.
+func (q Queue) PutContext(ctx context.Context, bodyText, bodyType string) error {
+	return q.PutBatchContext(ctx, []MessageBody{{Text: bodyText, Type: bodyType}})
+}
 
-	data, err := json.Marshal(request)
+// PutValue marshals v to JSON and sends it as a single message with
+// BodyType set to "application/json".
+func (q Queue) PutValue(v interface{}) error {
+	return q.PutValueContext(context.Background(), v)
+}
+
+// PutValueContext is like PutValue but takes a context.Context governing
+// the request.
+func (q Queue) PutValueContext(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
+	return q.PutContext(ctx, string(data), "application/json")
+}
 
-	req, err := http.NewRequest(http.MethodPost, q.url, bytes.NewBuffer(data))
-	if err != nil {
-		return err
+// PutValues marshals each value in values to JSON and sends them as a
+// single batch of messages with BodyType set to "application/json".
+func (q Queue) PutValues(values []interface{}) error {
+	return q.PutValuesContext(context.Background(), values)
+}
+
+// PutValuesContext is like PutValues but takes a context.Context
+// governing the request.
+func (q Queue) PutValuesContext(ctx context.Context, values []interface{}) error {
+	msgs := make([]MessageBody, len(values))
+	for i, v := range values {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		msgs[i] = MessageBody{Text: string(data), Type: "application/json"}
 	}
+	return q.PutBatchContext(ctx, msgs)
+}
+
+// PutWithOptions is like Put but lets the caller schedule delayed
+// delivery, a per-message TTL, or a non-default initial lease via opts.
+func (q Queue) PutWithOptions(bodyText, bodyType string, opts *PutOptions) error {
+	return q.PutWithOptionsContext(context.Background(), bodyText, bodyType, opts)
+}
+
+// PutWithOptionsContext is like PutWithOptions but takes a
+// context.Context governing the request.
+func (q Queue) PutWithOptionsContext(ctx context.Context, bodyText, bodyType string, opts *PutOptions) error {
+	return q.PutBatchContext(ctx, []MessageBody{NewMessageBody(bodyText, bodyType, opts)})
+}
+
+// PutBatchItem pairs a message body with the PutOptions to apply to it,
+// for use with PutBatchWithOptions.
+type PutBatchItem struct {
+	Text    string
+	Type    string
+	Options *PutOptions
+}
+
+// PutBatchWithOptions is the batching equivalent of PutWithOptions: each
+// item is scheduled, expired, and leased independently before being sent
+// as a single batch.
+func (q Queue) PutBatchWithOptions(items []PutBatchItem) error {
+	return q.PutBatchWithOptionsContext(context.Background(), items)
+}
 
-	if q.token != "" {
-		req.Header.Set("Authentication", "token "+q.token)
+// PutBatchWithOptionsContext is like PutBatchWithOptions but takes a
+// context.Context governing the request.
+func (q Queue) PutBatchWithOptionsContext(ctx context.Context, items []PutBatchItem) error {
+	msgs := make([]MessageBody, len(items))
+	for i, item := range items {
+		msgs[i] = NewMessageBody(item.Text, item.Type, item.Options)
 	}
+	return q.PutBatchContext(ctx, msgs)
+}
+
+// PutBatch sends multiple messages to the queue in a single request.
+func (q Queue) PutBatch(msgs []MessageBody) error {
+	return q.PutBatchContext(context.Background(), msgs)
+}
+
+// PutBatchContext is like PutBatch but takes a context.Context governing
+// the request.
+func (q Queue) PutBatchContext(ctx context.Context, msgs []MessageBody) error {
+	request := PutMessageRequest{Messages: msgs}
 
-	req.Close = true
-	req.Header.Set("Content-Type", "application/json")
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
 
-	res, err := client.Do(req)
+	res, err := q.doRequestRetrying(ctx, http.MethodPost, q.url, data, false)
 	if err != nil {
 		return err
 	}